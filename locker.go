@@ -0,0 +1,581 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"go.uber.org/zap"
+)
+
+// Locker is the pluggable backend behind S3.Lock/S3.Unlock. CertMagic calls
+// Lock before mutating shared state (e.g. issuing or renewing a
+// certificate) and Unlock once it is done, so that two Caddy instances
+// sharing the same storage never race on the same key. Selected via the
+// lock_backend config field ("fasms", "s3" or "dynamodb").
+type Locker interface {
+	Lock(ctx context.Context, key string, ttl time.Duration) error
+	Unlock(ctx context.Context, key string) error
+	// Cleanup releases any locks still held by this process.
+	Cleanup() error
+}
+
+// newHolderID returns a random identifier marking which process currently
+// holds a given lease.
+func newHolderID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// fasmsLockerBackend adapts the existing FASMS HTTP mutex service to the
+// Locker interface. Kept as the default for backward compatibility.
+//
+// locks is a sync.Map rather than a plain map because Caddy's certificate
+// maintenance calls Lock/Unlock/Cleanup concurrently for different (and
+// sometimes the same) keys; a plain map written from Lock and read/deleted
+// from Unlock/Cleanup races under that load. There is deliberately no
+// per-key mutex serializing Lock/Unlock for the same key: FASMS.Lock()
+// blocks polling the remote service until it's obtained or ctx expires, and
+// a local mutex held across that poll would block a concurrent Unlock for
+// the same key behind it — Unlock is exactly what releases the remote
+// mutex the polling Lock is waiting on, so that self-deadlocks.
+type fasmsLockerBackend struct {
+	client *FASMSLockerClient
+	logger *zap.Logger
+	locks  sync.Map // string -> *FASMSLocker
+}
+
+func newFASMSLockerBackend(endpoint, apiKey string, logger *zap.Logger) *fasmsLockerBackend {
+	return &fasmsLockerBackend{
+		client: &FASMSLockerClient{endpoint: endpoint, apiKey: apiKey},
+		logger: logger,
+	}
+}
+
+func (b *fasmsLockerBackend) Lock(ctx context.Context, key string, ttl time.Duration) error {
+	lock := &FASMSLocker{client: b.client, resourceName: key}
+	if err := lock.Lock(ctx, ttl); err != nil {
+		return err
+	}
+
+	b.locks.Store(key, lock)
+
+	return nil
+}
+
+func (b *fasmsLockerBackend) Unlock(ctx context.Context, key string) error {
+	value, exists := b.locks.LoadAndDelete(key)
+	if !exists {
+		return nil
+	}
+
+	return value.(*FASMSLocker).Unlock(ctx)
+}
+
+func (b *fasmsLockerBackend) Cleanup() error {
+	b.locks.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		lock := v.(*FASMSLocker)
+
+		if b.logger != nil {
+			b.logger.Info(fmt.Sprintf("Release FASMS Lock: %v", key))
+		}
+
+		_ = lock.Unlock(context.Background())
+		b.locks.Delete(key)
+
+		return true
+	})
+
+	return nil
+}
+
+// s3Lease is the JSON body written to a lock object, recording who holds the
+// lease, since when, and for how long.
+type s3Lease struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	TTLSeconds int       `json:"ttl_seconds"`
+}
+
+func (l s3Lease) expired() bool {
+	return time.Since(l.AcquiredAt) >= time.Duration(l.TTLSeconds)*time.Second
+}
+
+// s3LeaseRecord pairs a decoded lease with the ETag it was read at, so a
+// steal attempt can condition its overwrite on that exact ETag via
+// PutObjectOptions.SetMatchETag.
+type s3LeaseRecord struct {
+	lease s3Lease
+	etag  string
+}
+
+// s3LockerBackend implements Locker on top of the same bucket used for
+// certificate storage, so operators without a FASMS deployment don't need
+// one just to run certmagic-s3 on more than one node.
+//
+// keyMu serializes concurrent Lock(key) attempts from this process; it is
+// not also taken by Unlock, on purpose. Lock holds it for its whole retry
+// loop (which can block on the 500ms backoff below), and if Unlock needed
+// the same mutex a concurrent Lock for that key could never be interrupted
+// by the very Unlock that would let it proceed — the same self-deadlock
+// fasmsLockerBackend had to be fixed for.
+type s3LockerBackend struct {
+	client    *minio.Client
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	logger    *zap.Logger
+	holder    string
+
+	mu      sync.Mutex
+	renewal map[string]context.CancelFunc
+	keyMu   sync.Map // string -> *sync.Mutex, serializes reentrant Lock(key) on this process
+}
+
+func newS3LockerBackend(client *minio.Client, bucket, prefix, accessKey, secretKey string, logger *zap.Logger) *s3LockerBackend {
+	return &s3LockerBackend{
+		client:    client,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		logger:    logger,
+		holder:    newHolderID(),
+		renewal:   make(map[string]context.CancelFunc),
+	}
+}
+
+func (b *s3LockerBackend) mutexFor(key string) *sync.Mutex {
+	actual, _ := b.keyMu.LoadOrStore(key, &sync.Mutex{})
+	return actual.(*sync.Mutex)
+}
+
+// lockKeyMutex acquires mu, but gives up and returns ctx.Err() if ctx is
+// done first, so a caller whose deadline is about to pass can't be stuck
+// behind another goroutine's in-flight Lock for the same key. If ctx wins
+// the race, the acquisition is left to finish in the background and
+// immediately released, since nothing else will unlock it.
+func lockKeyMutex(ctx context.Context, mu *sync.Mutex) error {
+	acquired := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+func (b *s3LockerBackend) lockObjectKey(key string) string {
+	prefix := strings.TrimSuffix(b.prefix, "/")
+	return strings.Join([]string{prefix, "locks", key + ".lock"}, "/")
+}
+
+func (b *s3LockerBackend) readLease(ctx context.Context, objectKey string) (*s3LeaseRecord, error) {
+	object, err := b.client.GetObject(ctx, b.bucket, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var lease s3Lease
+	if err := json.NewDecoder(object).Decode(&lease); err != nil {
+		return nil, err
+	}
+
+	info, err := object.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3LeaseRecord{lease: lease, etag: info.ETag}, nil
+}
+
+func (b *s3LockerBackend) marshalLease(ttl time.Duration) ([]byte, error) {
+	lease := s3Lease{Holder: b.holder, AcquiredAt: time.Now(), TTLSeconds: int(ttl.Seconds())}
+	return json.Marshal(lease)
+}
+
+// writeLease unconditionally (re)writes the lease, used by the renewal
+// goroutine once this process already holds it.
+func (b *s3LockerBackend) writeLease(ctx context.Context, objectKey string, ttl time.Duration) error {
+	body, err := b.marshalLease(ttl)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.client.PutObject(ctx, b.bucket, objectKey, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{})
+
+	return err
+}
+
+// isPreconditionFailed reports whether err is the precondition-failed
+// response a conditional PutObject returns when its If-Match condition
+// wasn't met.
+func isPreconditionFailed(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "PreconditionFailed"
+}
+
+// errLockObjectExists is returned by putLockObjectIfAbsent when the
+// conditional create lost the race because an object already exists at
+// that key.
+var errLockObjectExists = errors.New("s3LockerBackend: lock object already exists")
+
+// putLockObjectIfAbsent creates objectKey with a real, unquoted
+// "If-None-Match: *" precondition — the literal RFC 7232 wildcard token
+// that S3 and MinIO honor as "fail unless no object currently exists at
+// this key." PutObjectOptions.SetMatchETagExcept can't be used for this: it
+// quotes its argument (sending If-None-Match: "*"), which both services
+// parse as an ordinary, literally unmatchable ETag comparison rather than
+// the special wildcard, so the precondition never fires and the PUT always
+// "succeeds" — exactly the double-lock race this backend exists to
+// prevent. There's no way to reach an unquoted header value through
+// minio-go v7.0.61's public PutObjectOptions API, so this builds and signs
+// the PUT directly with minio-go's own SigV4 signer instead.
+func (b *s3LockerBackend) putLockObjectIfAbsent(ctx context.Context, objectKey string, body []byte) error {
+	location, err := b.client.GetBucketLocation(ctx, b.bucket)
+	if err != nil {
+		return err
+	}
+
+	reqURL := *b.client.EndpointURL()
+	reqURL.Path = "/" + b.bucket + "/" + objectKey
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("If-None-Match", "*")
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	resp, err := http.DefaultClient.Do(signer.SignV4(*req, b.accessKey, b.secretKey, "", location))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errLockObjectExists
+	default:
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("s3LockerBackend: unexpected status %v creating lock object %v: %s", resp.StatusCode, objectKey, respBody)
+	}
+}
+
+// Lock acquires the lease at <prefix>/locks/<key>.lock with an atomic
+// conditional PUT (putLockObjectIfAbsent), which only succeeds if no object
+// currently exists at that key. If one does, and it has expired, the lease
+// is stolen with a second conditional PUT matched to that exact ETag
+// (SetMatchETag), so two racing stealers can't both "succeed" at once —
+// only one conditional PUT can match a given ETag.
+func (b *s3LockerBackend) Lock(ctx context.Context, key string, ttl time.Duration) error {
+	mu := b.mutexFor(key)
+	if err := lockKeyMutex(ctx, mu); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	objectKey := b.lockObjectKey(key)
+
+	for {
+		body, err := b.marshalLease(ttl)
+		if err != nil {
+			return err
+		}
+
+		err = b.putLockObjectIfAbsent(ctx, objectKey, body)
+		if err == nil {
+			b.startRenewal(key, objectKey, ttl)
+			return nil
+		}
+
+		if err != errLockObjectExists {
+			return err
+		}
+
+		existing, err := b.readLease(ctx, objectKey)
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				// Lease was released between our failed create and this
+				// read; retry immediately.
+				continue
+			}
+			return err
+		}
+
+		if !existing.lease.expired() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(500 * time.Millisecond):
+				continue
+			}
+		}
+
+		stealBody, err := b.marshalLease(ttl)
+		if err != nil {
+			return err
+		}
+
+		stealOpts := minio.PutObjectOptions{}
+		stealOpts.SetMatchETag(existing.etag)
+
+		_, err = b.client.PutObject(ctx, b.bucket, objectKey, bytes.NewReader(stealBody), int64(len(stealBody)), stealOpts)
+		if err == nil {
+			b.startRenewal(key, objectKey, ttl)
+			return nil
+		}
+
+		if !isPreconditionFailed(err) {
+			return err
+		}
+
+		// Someone else stole (or refreshed) it first; loop and reassess.
+	}
+}
+
+// startRenewal refreshes the lease at ttl/3 until Unlock cancels it, so a
+// long-held lock (e.g. a slow ACME challenge) doesn't expire out from under
+// its holder.
+func (b *s3LockerBackend) startRenewal(key, objectKey string, ttl time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b.mu.Lock()
+	b.renewal[key] = cancel
+	b.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := b.writeLease(ctx, objectKey, ttl); err != nil && b.logger != nil {
+					b.logger.Error(fmt.Sprintf("S3 lock renewal failed for %v: %v", key, err))
+				}
+			}
+		}
+	}()
+}
+
+func (b *s3LockerBackend) Unlock(ctx context.Context, key string) error {
+	b.mu.Lock()
+	if cancel, exists := b.renewal[key]; exists {
+		cancel()
+		delete(b.renewal, key)
+	}
+	b.mu.Unlock()
+
+	err := b.client.RemoveObject(ctx, b.bucket, b.lockObjectKey(key), minio.RemoveObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+
+	return nil
+}
+
+func (b *s3LockerBackend) Cleanup() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, cancel := range b.renewal {
+		cancel()
+		delete(b.renewal, key)
+		_ = b.client.RemoveObject(context.Background(), b.bucket, b.lockObjectKey(key), minio.RemoveObjectOptions{})
+	}
+
+	return nil
+}
+
+// dynamodbLockerBackend implements Locker with a DynamoDB table for users
+// already running on AWS who'd rather not add an S3 round-trip per lock
+// attempt. The table needs a string hash key named "LockKey".
+//
+// keyMu serializes concurrent Lock(key) attempts from this process the same
+// way s3LockerBackend's does, and for the same reason Unlock doesn't also
+// take it: Lock holds it across its whole retry loop, and Unlock is what
+// lets a contended Lock's condition eventually succeed, so blocking Unlock
+// behind it would self-deadlock.
+type dynamodbLockerBackend struct {
+	client *dynamodb.Client
+	table  string
+	logger *zap.Logger
+	holder string
+
+	mu      sync.Mutex
+	renewal map[string]context.CancelFunc
+	keyMu   sync.Map // string -> *sync.Mutex, serializes reentrant Lock(key) on this process
+}
+
+func (b *dynamodbLockerBackend) mutexFor(key string) *sync.Mutex {
+	actual, _ := b.keyMu.LoadOrStore(key, &sync.Mutex{})
+	return actual.(*sync.Mutex)
+}
+
+func newDynamoDBLockerBackend(ctx context.Context, region, table string, logger *zap.Logger) (*dynamodbLockerBackend, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodbLockerBackend: could not load AWS config: %w", err)
+	}
+
+	return &dynamodbLockerBackend{
+		client:  dynamodb.NewFromConfig(cfg),
+		table:   table,
+		logger:  logger,
+		holder:  newHolderID(),
+		renewal: make(map[string]context.CancelFunc),
+	}, nil
+}
+
+func (b *dynamodbLockerBackend) item(key string, ttl time.Duration) map[string]types.AttributeValue {
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	return map[string]types.AttributeValue{
+		"LockKey":   &types.AttributeValueMemberS{Value: key},
+		"Holder":    &types.AttributeValueMemberS{Value: b.holder},
+		"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+	}
+}
+
+// Lock writes a conditional item that succeeds only if no item exists for
+// this key, or the existing one has already expired, implementing the same
+// steal-on-expiry lease semantics as the S3-native backend.
+func (b *dynamodbLockerBackend) Lock(ctx context.Context, key string, ttl time.Duration) error {
+	mu := b.mutexFor(key)
+	if err := lockKeyMutex(ctx, mu); err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	for {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+
+		_, err := b.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(b.table),
+			Item:                b.item(key, ttl),
+			ConditionExpression: aws.String("attribute_not_exists(LockKey) OR ExpiresAt < :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: now},
+			},
+		})
+
+		if err == nil {
+			b.startRenewal(key, ttl)
+			return nil
+		}
+
+		var conditionFailed *types.ConditionalCheckFailedException
+		if !errors.As(err, &conditionFailed) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (b *dynamodbLockerBackend) startRenewal(key string, ttl time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b.mu.Lock()
+	b.renewal[key] = cancel
+	b.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := b.client.PutItem(ctx, &dynamodb.PutItemInput{
+					TableName: aws.String(b.table),
+					Item:      b.item(key, ttl),
+				})
+				if err != nil && b.logger != nil {
+					b.logger.Error(fmt.Sprintf("DynamoDB lock renewal failed for %v: %v", key, err))
+				}
+			}
+		}
+	}()
+}
+
+func (b *dynamodbLockerBackend) Unlock(ctx context.Context, key string) error {
+	b.mu.Lock()
+	if cancel, exists := b.renewal[key]; exists {
+		cancel()
+		delete(b.renewal, key)
+	}
+	b.mu.Unlock()
+
+	_, err := b.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(b.table),
+		Key: map[string]types.AttributeValue{
+			"LockKey": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+
+	return err
+}
+
+func (b *dynamodbLockerBackend) Cleanup() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, cancel := range b.renewal {
+		cancel()
+		delete(b.renewal, key)
+		_, _ = b.client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(b.table),
+			Key: map[string]types.AttributeValue{
+				"LockKey": &types.AttributeValueMemberS{Value: key},
+			},
+		})
+	}
+
+	return nil
+}
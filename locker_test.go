@@ -0,0 +1,231 @@
+package certmagic_s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// fakeFASMSServer is a minimal in-memory stand-in for the FASMS mutex
+// service, just enough to exercise fasmsLockerBackend's real HTTP calls in
+// tests without a live FASMS deployment.
+type fakeFASMSServer struct {
+	mu   sync.Mutex
+	held map[string]string // resource name -> holder uuid
+	seq  int
+}
+
+func newFakeFASMSServer() *httptest.Server {
+	f := &fakeFASMSServer{held: make(map[string]string)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/mutex", func(w http.ResponseWriter, r *http.Request) {
+		resource := r.URL.Query().Get("resource_name")
+
+		switch r.Method {
+		case http.MethodGet:
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			if _, busy := f.held[resource]; busy {
+				_ = json.NewEncoder(w).Encode(FASMSObtainMutexResponse{Obtained: false})
+				return
+			}
+
+			f.seq++
+			uuid := fmt.Sprintf("uuid-%d", f.seq)
+			f.held[resource] = uuid
+
+			_ = json.NewEncoder(w).Encode(FASMSObtainMutexResponse{Obtained: true, UUID: uuid})
+		case http.MethodDelete:
+			uuid := r.URL.Query().Get("uuid")
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			if f.held[resource] != uuid {
+				_ = json.NewEncoder(w).Encode(FASMSReleaseMutexResponse{Released: false})
+				return
+			}
+
+			delete(f.held, resource)
+			_ = json.NewEncoder(w).Encode(FASMSReleaseMutexResponse{Released: true})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+// TestFASMSLockerBackendConcurrentLockUnlock drives 100 goroutines locking
+// and unlocking a handful of overlapping keys at once, to catch the races
+// the plain map this backend used to use was prone to.
+func TestFASMSLockerBackendConcurrentLockUnlock(t *testing.T) {
+	server := newFakeFASMSServer()
+	defer server.Close()
+
+	backend := newFASMSLockerBackend(server.URL, "test-api-key", nil)
+
+	// FASMSLocker.Lock polls every 500ms with no jitter, so contenders for
+	// the same key are resolved roughly one per poll interval; spread the
+	// goroutines across enough keys that no single key sees so much
+	// contention it can't resolve within a goroutine's own context timeout.
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := keys[i%len(keys)]
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := backend.Lock(ctx, key, time.Minute); err != nil {
+				t.Errorf("Lock(%v): %v", key, err)
+				return
+			}
+
+			if err := backend.Unlock(context.Background(), key); err != nil {
+				t.Errorf("Unlock(%v): %v", key, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	backend.locks.Range(func(key, _ interface{}) bool {
+		t.Errorf("lock for %v still held after all goroutines finished", key)
+		return true
+	})
+}
+
+// TestMutexForIsStablePerKey checks that mutexFor hands back the same
+// *sync.Mutex for repeated calls with the same key, and distinct mutexes
+// for different keys, which is what makes per-key Lock serialization work.
+func TestMutexForIsStablePerKey(t *testing.T) {
+	backend := &s3LockerBackend{}
+
+	a1 := backend.mutexFor("a")
+	a2 := backend.mutexFor("a")
+	b := backend.mutexFor("b")
+
+	if a1 != a2 {
+		t.Error("mutexFor returned different mutexes for the same key")
+	}
+
+	if a1 == b {
+		t.Error("mutexFor returned the same mutex for different keys")
+	}
+}
+
+// TestLockKeyMutexHonorsContextCancellation checks that lockKeyMutex gives
+// up waiting once ctx is done, instead of blocking forever behind another
+// holder, and that it still unlocks the mutex once it does acquire it in
+// the background so a later caller isn't wedged.
+func TestLockKeyMutexHonorsContextCancellation(t *testing.T) {
+	var mu sync.Mutex
+	mu.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := lockKeyMutex(ctx, &mu); err != context.DeadlineExceeded {
+		t.Fatalf("lockKeyMutex = %v, want context.DeadlineExceeded", err)
+	}
+
+	mu.Unlock()
+
+	acquired := make(chan struct{})
+	go func() {
+		if err := lockKeyMutex(context.Background(), &mu); err != nil {
+			t.Errorf("lockKeyMutex after release: %v", err)
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lockKeyMutex never acquired the mutex after it was released")
+	}
+}
+
+// fakeS3PreconditionServer is a minimal in-memory stand-in for an S3/MinIO
+// endpoint that enforces "If-None-Match: *" on PUT, the one behavior
+// putLockObjectIfAbsent depends on to make lock creation atomic.
+type fakeS3PreconditionServer struct {
+	mu      sync.Mutex
+	objects map[string]bool
+}
+
+func newFakeS3PreconditionServer() *httptest.Server {
+	f := &fakeS3PreconditionServer{objects: make(map[string]bool)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if r.Header.Get("If-None-Match") == "*" && f.objects[r.URL.Path] {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		f.objects[r.URL.Path] = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func newTestS3LockerBackend(t *testing.T, endpoint string) *s3LockerBackend {
+	t.Helper()
+
+	client, err := minio.New(endpoint[len("http://"):], &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Secure: false,
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("minio.New: %v", err)
+	}
+
+	return newS3LockerBackend(client, "test-bucket", "certmagic", "access", "secret", nil)
+}
+
+// TestPutLockObjectIfAbsentRejectsConflict checks that a second conditional
+// create for the same object is rejected rather than silently overwriting an
+// existing lock, which is the atomicity putLockObjectIfAbsent exists for.
+func TestPutLockObjectIfAbsentRejectsConflict(t *testing.T) {
+	server := newFakeS3PreconditionServer()
+	defer server.Close()
+
+	backend := newTestS3LockerBackend(t, server.URL)
+	ctx := context.Background()
+
+	if err := backend.putLockObjectIfAbsent(ctx, "certmagic/locks/a.lock", []byte("first")); err != nil {
+		t.Fatalf("first putLockObjectIfAbsent: %v", err)
+	}
+
+	err := backend.putLockObjectIfAbsent(ctx, "certmagic/locks/a.lock", []byte("second"))
+	if err != errLockObjectExists {
+		t.Fatalf("second putLockObjectIfAbsent = %v, want errLockObjectExists", err)
+	}
+}
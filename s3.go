@@ -3,9 +3,12 @@ package certmagic_s3
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -14,10 +17,13 @@ import (
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
 )
 
 type FASMSLockerClient struct {
@@ -171,14 +177,53 @@ type S3 struct {
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
 	Prefix    string `json:"prefix"`
+	PartSize  int64  `json:"part_size"` // multipart upload part size in bytes, default 16 MiB
 
-	// FASMS
-	FASMSClient   *FASMSLockerClient
-	FASMSLocks    map[string]*FASMSLocker
+	// FASMS (used when lock_backend is "fasms", the default)
 	FASMSEndpoint string `json:"fasms_endpoint"`
 	FASMSApiKey   string `json:"fasms_api_key"`
+
+	// Locking
+	LockBackend    string `json:"lock_backend"` // "fasms" (default), "s3" or "dynamodb"
+	DynamoDBTable  string `json:"dynamodb_table"`
+	DynamoDBRegion string `json:"dynamodb_region"`
+	locker         Locker
+
+	// Server-side encryption
+	SSEMode        string `json:"sse_mode"` // "sse-s3", "sse-kms" or "sse-c"
+	SSEKMSKeyID    string `json:"sse_kms_key_id"`
+	SSECustomerKey string `json:"sse_customer_key"`
+	sse            encrypt.ServerSide
+
+	// Versioning, retention and integrity
+	Versioning bool             `json:"versioning"`
+	ObjectLock ObjectLockConfig `json:"object_lock"`
+}
+
+// ObjectLockConfig configures S3 Object Lock (WORM) retention applied to
+// every object written through Store and StoreReader (lock objects and the
+// SSE self-test object get none), so a botched renewal or a compromised
+// bucket write can't silently overwrite or delete a working certificate.
+type ObjectLockConfig struct {
+	Mode       string `json:"mode"` // "GOVERNANCE" or "COMPLIANCE"
+	RetainDays int    `json:"retain_days"`
 }
 
+// ErrIntegrity is returned by Load when the SHA-256 digest stored alongside
+// an object (in its x-amz-meta-certmagic-sha256 user metadata) doesn't
+// match the downloaded content, so CertMagic can log loudly instead of
+// silently serving corrupted certificate material.
+var ErrIntegrity = errors.New("certmagic-s3: object failed SHA-256 integrity check")
+
+// integrityMetadataKey is the UserMetadata key (without the x-amz-meta-
+// prefix minio-go adds automatically) used to store an object's SHA-256
+// digest.
+const integrityMetadataKey = "certmagic-sha256"
+
+// defaultPartSize is used for multipart uploads of unknown-size streams
+// when part_size isn't configured.
+const defaultPartSize = 16 * 1024 * 1024 // 16 MiB
+
 func init() {
 	caddy.RegisterModule(new(S3))
 }
@@ -186,6 +231,27 @@ func init() {
 func (s3 *S3) Provision(context caddy.Context) error {
 	s3.Logger = context.Logger(s3)
 
+	// Expand {env.X} placeholders in every string field before using them.
+	repl := caddy.NewReplacer()
+	s3.Host = repl.ReplaceAll(s3.Host, "")
+	s3.Bucket = repl.ReplaceAll(s3.Bucket, "")
+	s3.AccessKey = repl.ReplaceAll(s3.AccessKey, "")
+	s3.SecretKey = repl.ReplaceAll(s3.SecretKey, "")
+	s3.Prefix = repl.ReplaceAll(s3.Prefix, "")
+	s3.FASMSEndpoint = repl.ReplaceAll(s3.FASMSEndpoint, "")
+	s3.FASMSApiKey = repl.ReplaceAll(s3.FASMSApiKey, "")
+	s3.SSEKMSKeyID = repl.ReplaceAll(s3.SSEKMSKeyID, "")
+	s3.SSECustomerKey = repl.ReplaceAll(s3.SSECustomerKey, "")
+	s3.LockBackend = repl.ReplaceAll(s3.LockBackend, "")
+	s3.DynamoDBTable = repl.ReplaceAll(s3.DynamoDBTable, "")
+	s3.DynamoDBRegion = repl.ReplaceAll(s3.DynamoDBRegion, "")
+	s3.SSEMode = repl.ReplaceAll(s3.SSEMode, "")
+	s3.ObjectLock.Mode = repl.ReplaceAll(s3.ObjectLock.Mode, "")
+
+	if s3.PartSize <= 0 {
+		s3.PartSize = defaultPartSize
+	}
+
 	// S3 Client
 	client, _ := minio.New(s3.Host, &minio.Options{
 		Creds:  credentials.NewStaticV4(s3.AccessKey, s3.SecretKey, ""),
@@ -194,9 +260,291 @@ func (s3 *S3) Provision(context caddy.Context) error {
 
 	s3.Client = client
 
-	// FASMS Client
-	s3.FASMSClient = &FASMSLockerClient{endpoint: s3.FASMSEndpoint, apiKey: s3.FASMSApiKey}
-	s3.FASMSLocks = make(map[string]*FASMSLocker)
+	locker, err := s3.buildLocker(context)
+	if err != nil {
+		return err
+	}
+	s3.locker = locker
+
+	sse, err := s3.buildServerSideEncryption()
+	if err != nil {
+		return err
+	}
+	s3.sse = sse
+
+	if s3.sse != nil {
+		if err := s3.selfTestEncryption(); err != nil {
+			return err
+		}
+	}
+
+	if s3.Versioning {
+		err := s3.Client.SetBucketVersioning(context, s3.Bucket, minio.BucketVersioningConfiguration{Status: "Enabled"})
+		if err != nil {
+			return fmt.Errorf("S3 Provision: could not enable bucket versioning: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalCaddyfile lets the S3 storage module be configured in native
+// Caddyfile syntax instead of raw JSON, e.g.:
+//
+//	storage s3 {
+//		host      {env.S3_HOST}
+//		bucket    {env.S3_BUCKET}
+//		access_key {env.S3_ACCESS_KEY}
+//		secret_key {env.S3_SECRET_KEY}
+//		prefix    certmagic
+//		part_size 16777216
+//		fasms_endpoint {env.FASMS_ENDPOINT}
+//		fasms_api_key  {env.FASMS_API_KEY}
+//		lock_backend   s3
+//		dynamodb_table certmagic-locks
+//		dynamodb_region us-east-1
+//		sse_mode         sse-kms
+//		sse_kms_key_id   {env.SSE_KMS_KEY_ID}
+//		sse_customer_key {env.SSE_CUSTOMER_KEY}
+//		versioning true
+//		object_lock {
+//			mode        GOVERNANCE
+//			retain_days 30
+//		}
+//	}
+func (s3 *S3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "host":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.Host = d.Val()
+			case "bucket":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.Bucket = d.Val()
+			case "access_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.AccessKey = d.Val()
+			case "secret_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.SecretKey = d.Val()
+			case "prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.Prefix = d.Val()
+			case "part_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				partSize, err := strconv.ParseInt(d.Val(), 10, 64)
+				if err != nil {
+					return d.Errf("invalid part_size: %v", err)
+				}
+				s3.PartSize = partSize
+			case "fasms_endpoint":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.FASMSEndpoint = d.Val()
+			case "fasms_api_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.FASMSApiKey = d.Val()
+			case "lock_backend":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.LockBackend = d.Val()
+			case "dynamodb_table":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.DynamoDBTable = d.Val()
+			case "dynamodb_region":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.DynamoDBRegion = d.Val()
+			case "sse_mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.SSEMode = d.Val()
+			case "sse_kms_key_id":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.SSEKMSKeyID = d.Val()
+			case "sse_customer_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				s3.SSECustomerKey = d.Val()
+			case "versioning":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				versioning, err := strconv.ParseBool(d.Val())
+				if err != nil {
+					return d.Errf("invalid versioning: %v", err)
+				}
+				s3.Versioning = versioning
+			case "object_lock":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "mode":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						s3.ObjectLock.Mode = d.Val()
+					case "retain_days":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						retainDays, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid retain_days: %v", err)
+						}
+						s3.ObjectLock.RetainDays = retainDays
+					default:
+						return d.ArgErr()
+					}
+				}
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate implements caddy.Validator, checking that the configured bucket
+// exists and is reachable with the provided credentials before Caddy starts
+// serving, so a misconfiguration is caught at startup instead of at first
+// cert issuance.
+func (s3 *S3) Validate() error {
+	exists, err := s3.Client.BucketExists(context.Background(), s3.Bucket)
+	if err != nil {
+		return fmt.Errorf("S3 Validate: could not verify bucket '%v': %w", s3.Bucket, err)
+	}
+
+	if !exists {
+		return fmt.Errorf("S3 Validate: bucket '%v' does not exist", s3.Bucket)
+	}
+
+	switch s3.ObjectLock.Mode {
+	case "", "GOVERNANCE", "COMPLIANCE":
+	default:
+		return fmt.Errorf("S3 Validate: unknown object_lock mode '%v'", s3.ObjectLock.Mode)
+	}
+
+	if s3.ObjectLock.Mode != "" && s3.ObjectLock.RetainDays <= 0 {
+		return errors.New("S3 Validate: object_lock requires retain_days > 0")
+	}
+
+	return nil
+}
+
+// buildLocker constructs the Locker selected by lock_backend ("fasms" by
+// default, for backward compatibility; "s3" or "dynamodb" otherwise).
+func (s3 *S3) buildLocker(ctx caddy.Context) (Locker, error) {
+	switch s3.LockBackend {
+	case "", "fasms":
+		return newFASMSLockerBackend(s3.FASMSEndpoint, s3.FASMSApiKey, s3.Logger), nil
+	case "s3":
+		return newS3LockerBackend(s3.Client, s3.Bucket, s3.Prefix, s3.AccessKey, s3.SecretKey, s3.Logger), nil
+	case "dynamodb":
+		if s3.DynamoDBTable == "" {
+			return nil, errors.New("S3 Provision: lock_backend 'dynamodb' requires dynamodb_table")
+		}
+		return newDynamoDBLockerBackend(ctx, s3.DynamoDBRegion, s3.DynamoDBTable, s3.Logger)
+	default:
+		return nil, fmt.Errorf("S3 Provision: unknown lock_backend '%v'", s3.LockBackend)
+	}
+}
+
+// buildServerSideEncryption turns the sse_mode/sse_kms_key_id/sse_customer_key
+// config fields into the encrypt.ServerSide value used on every PutObject and
+// GetObject call. It returns (nil, nil) when sse_mode is unset.
+func (s3 *S3) buildServerSideEncryption() (encrypt.ServerSide, error) {
+	switch s3.SSEMode {
+	case "":
+		return nil, nil
+	case "sse-s3":
+		return encrypt.NewSSE(), nil
+	case "sse-kms":
+		if s3.SSEKMSKeyID == "" {
+			return nil, errors.New("S3 Provision: sse_mode 'sse-kms' requires sse_kms_key_id")
+		}
+		return encrypt.NewSSEKMS(s3.SSEKMSKeyID, nil)
+	case "sse-c":
+		if s3.SSECustomerKey == "" {
+			return nil, errors.New("S3 Provision: sse_mode 'sse-c' requires sse_customer_key")
+		}
+		key, err := deriveSSECKey(s3.SSECustomerKey)
+		if err != nil {
+			return nil, fmt.Errorf("S3 Provision: could not derive SSE-C key: %w", err)
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("S3 Provision: unknown sse_mode '%v'", s3.SSEMode)
+	}
+}
+
+// deriveSSECKey stretches a human-readable passphrase into the 32-byte key
+// SSE-C requires, via HKDF-SHA256, so operators don't have to manage raw key
+// material.
+func deriveSSECKey(passphrase string) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, []byte(passphrase), nil, []byte("certmagic-s3 sse-c"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// selfTestEncryption round-trips a small object through the configured SSE
+// backend so a bad KMS key or SSE-C passphrase fails at startup rather than
+// at first cert issuance.
+func (s3 *S3) selfTestEncryption() error {
+	key := s3.KeyPrefix(".certmagic-s3-sse-selftest")
+	payload := []byte("certmagic-s3 sse self-test")
+
+	_, err := s3.Client.PutObject(context.Background(), s3.Bucket, key, bytes.NewReader(payload), int64(len(payload)), minio.PutObjectOptions{
+		ServerSideEncryption: s3.sse,
+	})
+	if err != nil {
+		return fmt.Errorf("S3 Provision: SSE self-test PutObject failed: %w", err)
+	}
+
+	object, err := s3.Client.GetObject(context.Background(), s3.Bucket, key, minio.GetObjectOptions{
+		ServerSideEncryption: s3.sse,
+	})
+	if err != nil {
+		return fmt.Errorf("S3 Provision: SSE self-test GetObject failed: %w", err)
+	}
+
+	content, err := ioutil.ReadAll(object)
+	if err != nil {
+		return fmt.Errorf("S3 Provision: SSE self-test read failed: %w", err)
+	}
+
+	if !bytes.Equal(content, payload) {
+		return errors.New("S3 Provision: SSE self-test readback mismatch")
+	}
+
+	_ = s3.Client.RemoveObject(context.Background(), s3.Bucket, key, minio.RemoveObjectOptions{})
 
 	return nil
 }
@@ -206,10 +554,8 @@ func (s3 *S3) Cleanup() error {
 		s3.Logger.Info("S3 Cleanup")
 	}
 
-	for _, lock := range s3.FASMSLocks {
-		s3.Logger.Info(fmt.Sprintf("Release FASMS Lock: %v", lock.resourceName))
-
-		_ = lock.Unlock(context.Background())
+	if s3.locker != nil {
+		return s3.locker.Cleanup()
 	}
 
 	return nil
@@ -231,11 +577,7 @@ func (s3 *S3) CertMagicStorage() (certmagic.Storage, error) {
 func (s3 *S3) Lock(ctx context.Context, key string) error {
 	s3.Logger.Info(fmt.Sprintf("Lock: %v", key))
 
-	lock := &FASMSLocker{client: s3.FASMSClient, resourceName: key}
-	err := lock.Lock(ctx, time.Minute)
-
-	s3.FASMSLocks[key] = lock
-
+	err := s3.locker.Lock(ctx, key, time.Minute)
 	if err != nil {
 		s3.Logger.Error(fmt.Sprintf("Lock error: %v", err))
 	}
@@ -243,69 +585,178 @@ func (s3 *S3) Lock(ctx context.Context, key string) error {
 	return err
 }
 
-func (s3 *S3) Unlock(key string) error {
-	if lock, exists := s3.FASMSLocks[key]; exists {
-		s3.Logger.Info(fmt.Sprintf("Release lock: %v", key))
+func (s3 *S3) Unlock(ctx context.Context, key string) error {
+	s3.Logger.Info(fmt.Sprintf("Release lock: %v", key))
 
-		err := lock.Unlock(context.Background())
+	return s3.locker.Unlock(ctx, key)
+}
 
-		delete(s3.FASMSLocks, key)
+func (s3 *S3) Store(ctx context.Context, key string, value []byte) error {
+	sum := sha256.Sum256(value)
 
-		if err != nil {
-			return err
-		}
-	}
+	return s3.storeReader(ctx, key, bytes.NewReader(value), int64(len(value)), hex.EncodeToString(sum[:]))
+}
 
-	return nil
+// StoreReader writes r to key without buffering it into memory first. Pass
+// size -1 for unknown-length streams to have minio-go fall back to
+// automatic multipart upload (see part_size), so multi-hundred-MB objects
+// don't OOM the process. The SHA-256 integrity tag Store sets isn't
+// computed here, since that would require buffering the stream anyway.
+func (s3 *S3) StoreReader(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s3.storeReader(ctx, key, r, size, "")
 }
 
-func (s3 *S3) Store(key string, value []byte) error {
+func (s3 *S3) storeReader(ctx context.Context, key string, r io.Reader, size int64, sha256Hex string) error {
 	key = s3.KeyPrefix(key)
 
-	s3.Logger.Info(fmt.Sprintf("Store: %v, %v bytes", key, len(value)))
+	if size < 0 {
+		s3.Logger.Info(fmt.Sprintf("Store: %v, streaming (size unknown)", key))
+	} else {
+		s3.Logger.Info(fmt.Sprintf("Store: %v, %v bytes", key, size))
+	}
+
+	opts := minio.PutObjectOptions{
+		ServerSideEncryption: s3.sse,
+		PartSize:             uint64(s3.PartSize),
+	}
+
+	if sha256Hex != "" {
+		opts.UserMetadata = map[string]string{integrityMetadataKey: sha256Hex}
+	}
+
+	if mode, retainUntil, ok := s3.objectLockRetention(); ok {
+		opts.Mode = mode
+		opts.RetainUntilDate = retainUntil
+	}
 
-	_, err := s3.Client.PutObject(context.Background(), s3.Bucket, key, bytes.NewReader(value), int64(len(value)), minio.PutObjectOptions{})
+	_, err := s3.Client.PutObject(ctx, s3.Bucket, key, r, size, opts)
 
 	return err
 }
 
-func (s3 *S3) Load(key string) ([]byte, error) {
-	key = s3.KeyPrefix(key)
-
-	s3.Logger.Info(fmt.Sprintf("Load: %v", key))
+// objectLockRetention turns the object_lock config into the retention mode
+// and RetainUntilDate PutObject expects, so keys stay immutable for that
+// window. The second return value is false when object_lock isn't set.
+func (s3 *S3) objectLockRetention() (minio.RetentionMode, time.Time, bool) {
+	if s3.ObjectLock.Mode == "" || s3.ObjectLock.RetainDays <= 0 {
+		return "", time.Time{}, false
+	}
 
-	object, err := s3.Client.GetObject(context.Background(), s3.Bucket, key, minio.GetObjectOptions{})
+	return minio.RetentionMode(s3.ObjectLock.Mode), time.Now().AddDate(0, 0, s3.ObjectLock.RetainDays), true
+}
 
+func (s3 *S3) Load(ctx context.Context, key string) ([]byte, error) {
+	object, prefixedKey, err := s3.loadObject(ctx, key)
 	if err != nil {
 		return nil, err
 	}
+	defer object.Close()
 
 	content, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	// object.Stat() is free here: minio-go already cached the ObjectInfo
+	// (including UserMetadata) from the GetObject response headers while
+	// the body above was read, so this doesn't issue a second request and
+	// can't race against a concurrent overwrite the way a follow-up
+	// StatObject call would.
+	info, err := object.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s3.verifyIntegrity(prefixedKey, content, info); err != nil {
+		return nil, err
+	}
 
-	return content, err
+	return content, nil
 }
 
-func (s3 *S3) Delete(key string) error {
+// verifyIntegrity recomputes the SHA-256 of content and compares it against
+// the digest recorded in info.UserMetadata at Store time. Objects written
+// without a recorded digest (e.g. via StoreReader, or predating this check)
+// are not verified.
+func (s3 *S3) verifyIntegrity(prefixedKey string, content []byte, info minio.ObjectInfo) error {
+	expected, ok := lookupUserMetadata(info.UserMetadata, integrityMetadataKey)
+	if !ok || expected == "" {
+		return nil
+	}
+
+	sum := sha256.Sum256(content)
+
+	if hex.EncodeToString(sum[:]) != expected {
+		s3.Logger.Error(fmt.Sprintf("Load: integrity check failed for %v", prefixedKey))
+		return ErrIntegrity
+	}
+
+	return nil
+}
+
+// lookupUserMetadata finds key in metadata regardless of whether it's
+// stored with its x-amz-meta- prefix or canonical header casing.
+func lookupUserMetadata(metadata map[string]string, key string) (string, bool) {
+	for k, v := range metadata {
+		trimmed := strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if trimmed == strings.ToLower(key) {
+			return v, true
+		}
+	}
+
+	return "", false
+}
+
+// loadObject issues the GetObject request shared by Load and LoadReader,
+// returning the prefixed key alongside it so callers needn't recompute it.
+func (s3 *S3) loadObject(ctx context.Context, key string) (*minio.Object, string, error) {
+	prefixedKey := s3.KeyPrefix(key)
+
+	s3.Logger.Info(fmt.Sprintf("Load: %v", prefixedKey))
+
+	object, err := s3.Client.GetObject(ctx, s3.Bucket, prefixedKey, minio.GetObjectOptions{
+		ServerSideEncryption: s3.sse,
+	})
+
+	return object, prefixedKey, err
+}
+
+// LoadReader returns the object body for key without reading it fully into
+// memory, so callers that only need to stream it (e.g. serving an OCSP
+// staple) aren't forced to buffer the whole thing. Unlike Load, it does not
+// verify the SHA-256 integrity tag, since doing so would require buffering
+// the stream anyway.
+func (s3 *S3) LoadReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, _, err := s3.loadObject(ctx, key)
+	return object, err
+}
+
+// Delete removes key. When versioning is enabled, S3 turns an unversioned
+// RemoveObject into a delete marker rather than an actual deletion, so the
+// prior content stays recoverable via ListVersions/Restore.
+func (s3 *S3) Delete(ctx context.Context, key string) error {
 	key = s3.KeyPrefix(key)
 
 	s3.Logger.Info(fmt.Sprintf("Delete: %v", key))
 
-	err := s3.Client.RemoveObject(context.Background(), s3.Bucket, key, minio.RemoveObjectOptions{})
+	err := s3.Client.RemoveObject(ctx, s3.Bucket, key, minio.RemoveObjectOptions{})
 
 	return err
 }
 
-func (s3 *S3) Exists(key string) bool {
+func (s3 *S3) Exists(ctx context.Context, key string) bool {
 	key = s3.KeyPrefix(key)
 
 	s3.Logger.Info(fmt.Sprintf("Exists: %v", key))
 
-	_, err := s3.Client.StatObject(context.Background(), s3.Bucket, key, minio.StatObjectOptions{})
+	_, err := s3.Client.StatObject(ctx, s3.Bucket, key, minio.StatObjectOptions{
+		ServerSideEncryption: s3.sse,
+	})
 
 	return err == nil
 }
 
-func (s3 *S3) List(prefix string, recursive bool) ([]string, error) {
+func (s3 *S3) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
 	prefix = s3.KeyPrefix(prefix)
 
 	if !strings.HasSuffix(prefix, "/") {
@@ -314,7 +765,7 @@ func (s3 *S3) List(prefix string, recursive bool) ([]string, error) {
 
 	var keys []string
 
-	objects := s3.Client.ListObjects(context.Background(), s3.Bucket, minio.ListObjectsOptions{
+	objects := s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
 		Prefix:    prefix,
 		Recursive: recursive,
 	})
@@ -328,12 +779,14 @@ func (s3 *S3) List(prefix string, recursive bool) ([]string, error) {
 	return keys, nil
 }
 
-func (s3 *S3) Stat(key string) (certmagic.KeyInfo, error) {
+func (s3 *S3) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
 	key = s3.KeyPrefix(key)
 
 	s3.Logger.Info(fmt.Sprintf("Stat: %v", key))
 
-	object, err := s3.Client.StatObject(context.Background(), s3.Bucket, key, minio.StatObjectOptions{})
+	object, err := s3.Client.StatObject(ctx, s3.Bucket, key, minio.StatObjectOptions{
+		ServerSideEncryption: s3.sse,
+	})
 
 	if err != nil {
 		return certmagic.KeyInfo{}, nil
@@ -347,6 +800,75 @@ func (s3 *S3) Stat(key string) (certmagic.KeyInfo, error) {
 	}, err
 }
 
+// ObjectVersion describes one version of a key, as returned by
+// ListVersions. It is only meaningful when versioning is enabled on the
+// bucket.
+type ObjectVersion struct {
+	VersionID      string
+	IsLatest       bool
+	IsDeleteMarker bool
+	Size           int64
+	LastModified   time.Time
+}
+
+// ListVersions lists every version of key, including delete markers, newest
+// first. It requires bucket versioning (versioning: true) to return more
+// than the current version.
+func (s3 *S3) ListVersions(ctx context.Context, key string) ([]ObjectVersion, error) {
+	prefixedKey := s3.KeyPrefix(key)
+
+	var versions []ObjectVersion
+
+	objects := s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
+		Prefix:       prefixedKey,
+		WithVersions: true,
+	})
+
+	for object := range objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		if object.Key != prefixedKey {
+			continue
+		}
+
+		versions = append(versions, ObjectVersion{
+			VersionID:      object.VersionID,
+			IsLatest:       object.IsLatest,
+			IsDeleteMarker: object.IsDeleteMarker,
+			Size:           object.Size,
+			LastModified:   object.LastModified,
+		})
+	}
+
+	return versions, nil
+}
+
+// Restore makes versionID the current version of key again, by copying it
+// over the live object. Use it to recover from a botched renewal or a
+// compromised overwrite once versioning has preserved the prior content.
+func (s3 *S3) Restore(ctx context.Context, key, versionID string) error {
+	prefixedKey := s3.KeyPrefix(key)
+
+	s3.Logger.Info(fmt.Sprintf("Restore: %v to version %v", prefixedKey, versionID))
+
+	src := minio.CopySrcOptions{
+		Bucket:    s3.Bucket,
+		Object:    prefixedKey,
+		VersionID: versionID,
+	}
+
+	dst := minio.CopyDestOptions{
+		Bucket: s3.Bucket,
+		Object: prefixedKey,
+	}
+
+	_, err := s3.Client.CopyObject(ctx, dst, src)
+
+	return err
+}
+
 func (s3 S3) KeyPrefix(prefix string) string {
 	if strings.HasPrefix(prefix, s3.Prefix) {
 		return prefix
@@ -355,4 +877,9 @@ func (s3 S3) KeyPrefix(prefix string) string {
 	}
 }
 
-var _ caddy.Provisioner = (*S3)(nil)
+var (
+	_ caddy.Provisioner     = (*S3)(nil)
+	_ caddy.Validator       = (*S3)(nil)
+	_ caddyfile.Unmarshaler = (*S3)(nil)
+	_ certmagic.Storage     = (*S3)(nil)
+)
@@ -0,0 +1,131 @@
+package certmagic_s3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	s3 := S3{Prefix: "certmagic"}
+
+	got := s3.KeyPrefix("acme/example.com/cert.pem")
+	want := "certmagic/acme/example.com/cert.pem"
+
+	if got != want {
+		t.Errorf("KeyPrefix() = %q, want %q", got, want)
+	}
+
+	// Already-prefixed keys are left alone.
+	if got := s3.KeyPrefix(want); got != want {
+		t.Errorf("KeyPrefix() on an already-prefixed key = %q, want %q", got, want)
+	}
+}
+
+func TestDeriveSSECKey(t *testing.T) {
+	key, err := deriveSSECKey("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("deriveSSECKey: %v", err)
+	}
+
+	if len(key) != 32 {
+		t.Errorf("deriveSSECKey returned %v bytes, want 32", len(key))
+	}
+
+	again, err := deriveSSECKey("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("deriveSSECKey: %v", err)
+	}
+
+	if string(key) != string(again) {
+		t.Error("deriveSSECKey is not deterministic for the same passphrase")
+	}
+
+	other, err := deriveSSECKey("a different passphrase")
+	if err != nil {
+		t.Fatalf("deriveSSECKey: %v", err)
+	}
+
+	if string(key) == string(other) {
+		t.Error("deriveSSECKey produced the same key for different passphrases")
+	}
+}
+
+func TestBuildServerSideEncryption(t *testing.T) {
+	cases := []struct {
+		name    string
+		s3      S3
+		wantErr bool
+	}{
+		{name: "unset", s3: S3{}},
+		{name: "sse-s3", s3: S3{SSEMode: "sse-s3"}},
+		{name: "sse-kms missing key id", s3: S3{SSEMode: "sse-kms"}, wantErr: true},
+		{name: "sse-kms", s3: S3{SSEMode: "sse-kms", SSEKMSKeyID: "arn:aws:kms:key"}},
+		{name: "sse-c missing customer key", s3: S3{SSEMode: "sse-c"}, wantErr: true},
+		{name: "sse-c", s3: S3{SSEMode: "sse-c", SSECustomerKey: "passphrase"}},
+		{name: "unknown mode", s3: S3{SSEMode: "sse-unknown"}, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := c.s3.buildServerSideEncryption()
+
+			if c.wantErr && err == nil {
+				t.Error("expected an error, got nil")
+			}
+			if !c.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestObjectLockRetention(t *testing.T) {
+	unset := S3{}
+	if _, _, ok := unset.objectLockRetention(); ok {
+		t.Error("expected objectLockRetention to report unset when object_lock isn't configured")
+	}
+
+	zeroRetainDays := S3{ObjectLock: ObjectLockConfig{Mode: "GOVERNANCE"}}
+	if _, _, ok := zeroRetainDays.objectLockRetention(); ok {
+		t.Error("expected objectLockRetention to report unset when retain_days is 0")
+	}
+
+	configured := S3{ObjectLock: ObjectLockConfig{Mode: "COMPLIANCE", RetainDays: 30}}
+	mode, retainUntil, ok := configured.objectLockRetention()
+	if !ok {
+		t.Fatal("expected objectLockRetention to report configured")
+	}
+	if string(mode) != "COMPLIANCE" {
+		t.Errorf("mode = %v, want COMPLIANCE", mode)
+	}
+	if wantAfter := time.Now().Add(29 * 24 * time.Hour); !retainUntil.After(wantAfter) {
+		t.Errorf("retainUntil = %v, want after %v", retainUntil, wantAfter)
+	}
+}
+
+func TestLookupUserMetadata(t *testing.T) {
+	metadata := map[string]string{"X-Amz-Meta-Certmagic-Sha256": "abc123"}
+
+	got, ok := lookupUserMetadata(metadata, "certmagic-sha256")
+	if !ok || got != "abc123" {
+		t.Errorf("lookupUserMetadata = (%q, %v), want (\"abc123\", true)", got, ok)
+	}
+
+	if _, ok := lookupUserMetadata(metadata, "does-not-exist"); ok {
+		t.Error("lookupUserMetadata found a key that isn't present")
+	}
+}
+
+func TestBuildLocker(t *testing.T) {
+	var ctx caddy.Context
+
+	if _, err := (&S3{LockBackend: "dynamodb"}).buildLocker(ctx); err == nil {
+		t.Error("expected an error when lock_backend is dynamodb without dynamodb_table")
+	}
+
+	if _, err := (&S3{LockBackend: "unknown"}).buildLocker(ctx); err == nil {
+		t.Error("expected an error for an unknown lock_backend")
+	}
+}